@@ -0,0 +1,224 @@
+//  Copyright Brian Starkey <stark3y@gmail.com> 2016
+//
+//  Permission is hereby granted, free of charge, to any person obtaining a
+//  copy of this software and associated documentation files (the "Software"),
+//  to deal in the Software without restriction, including without limitation
+//  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+//  and/or sell copies of the Software, and to permit persons to whom the
+//  Software is furnished to do so, subject to the following conditions:
+//
+//  The above copyright notice and this permission notice shall be included in
+//  all copies or substantial portions of the Software.
+//
+//  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+//  OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+//  DEALINGS IN THE SOFTWARE.
+//
+// This file implements auto-generated directory listings, similar to
+// Caddy's "browse" middleware, for directories which have no index file.
+package main
+
+import (
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/template"
+	"time"
+)
+
+var browse bool
+var browsePatterns []*regexp.Regexp
+var browseTemplate *template.Template
+
+const defaultBrowseTemplate = `
+<html>
+	<head>
+		<title>{{ .Name }}</title>
+		<meta charset="utf-8">
+	</head>
+	<body>
+		<article>
+		<h1>{{ .Path }}</h1>
+		<table>
+			<thead>
+				<tr>
+					<th><a href="?sort=name&order={{ if and (eq .Sort "name") (eq .Order "asc") }}desc{{ else }}asc{{ end }}">Name</a></th>
+					<th><a href="?sort=size&order={{ if and (eq .Sort "size") (eq .Order "asc") }}desc{{ else }}asc{{ end }}">Size</a></th>
+					<th><a href="?sort=time&order={{ if and (eq .Sort "time") (eq .Order "asc") }}desc{{ else }}asc{{ end }}">Modified</a></th>
+				</tr>
+			</thead>
+			<tbody>
+				{{ if .CanGoUp }}
+				<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+				{{ end }}
+				{{ range .Items }}
+				<tr>
+					<td><a href="{{ .URL }}">{{ .Name }}{{ if .IsDir }}/{{ end }}</a></td>
+					<td>{{ if not .IsDir }}{{ .Size }}{{ end }}</td>
+					<td>{{ .ModTime }}</td>
+				</tr>
+				{{ end }}
+			</tbody>
+		</table>
+		<p>{{ .NumDirs }} directories, {{ .NumFiles }} files</p>
+		</article>
+	</body>
+</html>
+`
+
+// FileInfo describes a single entry in a directory Listing.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+	URL     string
+}
+
+// Listing is the data passed to the browse template when rendering an
+// auto-generated directory index.
+type Listing struct {
+	Name     string
+	Path     string
+	CanGoUp  bool
+	Items    []FileInfo
+	NumDirs  int
+	NumFiles int
+	Sort     string
+	Order    string
+}
+
+// shouldBrowse returns whether directory listings should be served for the
+// (absolute) directory path p, either because --browse is set globally, or
+// because p, taken relative to root, matches one of the --browse-path
+// patterns.
+func shouldBrowse(p string) bool {
+	if browse {
+		return true
+	}
+
+	relp, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+
+	for _, rex := range browsePatterns {
+		if rex.MatchString(relp) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortListing(items []FileInfo, by string, order string) {
+	var less func(i, j int) bool
+	switch by {
+	case "size":
+		less = func(i, j int) bool { return items[i].Size < items[j].Size }
+	case "time":
+		less = func(i, j int) bool { return items[i].ModTime.Before(items[j].ModTime) }
+	default:
+		by = "name"
+		less = func(i, j int) bool { return items[i].Name < items[j].Name }
+	}
+
+	sort.SliceStable(items, less)
+	if order == "desc" {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+}
+
+func serveBrowse(w http.ResponseWriter, r *http.Request, dir string) {
+	log.Printf("`-> Serving directory listing: %s\n", dir)
+
+	f, err := os.Open(dir)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	relDir, err := filepath.Rel(root, dir)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	order := r.URL.Query().Get("order")
+	if order != "desc" {
+		order = "asc"
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+	switch sortBy {
+	case "size", "time":
+	default:
+		sortBy = "name"
+	}
+
+	listing := &Listing{
+		Name:    html.EscapeString(relDir),
+		Path:    "/" + html.EscapeString(relDir),
+		CanGoUp: relDir != ".",
+		Sort:    sortBy,
+		Order:   order,
+	}
+
+	for _, fi := range entries {
+		relp := filepath.Join(relDir, fi.Name())
+
+		filtered := false
+		for _, rex := range filters {
+			if rex.MatchString(relp) {
+				filtered = true
+				break
+			}
+		}
+		if filtered {
+			continue
+		}
+
+		if fi.IsDir() {
+			listing.NumDirs++
+		} else {
+			listing.NumFiles++
+		}
+
+		url := fi.Name()
+		if fi.IsDir() {
+			url += "/"
+		}
+
+		listing.Items = append(listing.Items, FileInfo{
+			Name:    html.EscapeString(fi.Name()),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			IsDir:   fi.IsDir(),
+			URL:     html.EscapeString(url),
+		})
+	}
+
+	sortListing(listing.Items, listing.Sort, listing.Order)
+
+	err = browseTemplate.Execute(w, listing)
+	if err != nil {
+		log.Printf("*-> Error: %s\n", err)
+	}
+}
@@ -0,0 +1,158 @@
+//  Copyright Brian Starkey <stark3y@gmail.com> 2016
+//
+//  Permission is hereby granted, free of charge, to any person obtaining a
+//  copy of this software and associated documentation files (the "Software"),
+//  to deal in the Software without restriction, including without limitation
+//  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+//  and/or sell copies of the Software, and to permit persons to whom the
+//  Software is furnished to do so, subject to the following conditions:
+//
+//  The above copyright notice and this permission notice shall be included in
+//  all copies or substantial portions of the Software.
+//
+//  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+//  OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+//  DEALINGS IN THE SOFTWARE.
+//
+// This file implements conditional GET (ETag/Last-Modified) support, and
+// the in-memory LRU cache of rendered pages that sits behind it.
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// templateModTime is the mtime of the --template file, if any, folded
+// into the ETag of rendered pages so that changing the template busts
+// their cache entries even though the underlying markdown hasn't changed.
+var templateModTime time.Time
+
+// etagFor computes a strong ETag from a file's mtime and size, optionally
+// folded together with another timestamp (e.g. a template's mtime).
+func etagFor(fi os.FileInfo, extra time.Time) string {
+	stamp := fi.ModTime().UnixNano()
+	if !extra.IsZero() {
+		stamp ^= extra.UnixNano()
+	}
+	return fmt.Sprintf("\"%x-%x\"", stamp, fi.Size())
+}
+
+// checkConditional sets the ETag/Last-Modified headers for the response,
+// and - if the request's If-None-Match or If-Modified-Since headers say
+// the client's copy is still fresh - writes a 304 and returns true. The
+// caller should return immediately without writing a body when it does.
+func checkConditional(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if inm == "*" || inm == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		// The header only has one-second precision, so compare against
+		// the mtime truncated to match.
+		if err == nil && !modTime.Truncate(time.Second).After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// cacheEntry is what pageCache stores for a rendered markdown page, keyed
+// by resolved path + ETag so a changed mtime naturally misses the cache.
+type cacheEntry struct {
+	key      string
+	markup   []byte
+	meta     Meta
+	template string
+	size     int64
+}
+
+// lruCache is a byte-budgeted, least-recently-used cache of cacheEntry
+// values. A nil *lruCache, or one with maxBytes <= 0, behaves as always
+// empty and never retains anything - this is how --cache-size 0 (the
+// default) disables caching without extra branching at call sites. get
+// and set are safe to call concurrently, since they run on the
+// per-request goroutines net/http spawns for every connection.
+type lruCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	curBytes int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLRUCache(maxBytes int64) *lruCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) get(key string) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	c.ll.MoveToFront(e)
+	return e.Value.(cacheEntry), true
+}
+
+func (c *lruCache) set(entry cacheEntry) {
+	if c == nil || c.maxBytes <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[entry.key]; ok {
+		c.curBytes -= e.Value.(cacheEntry).size
+		c.ll.Remove(e)
+	}
+
+	c.items[entry.key] = c.ll.PushFront(entry)
+	c.curBytes += entry.size
+
+	for c.curBytes > c.maxBytes {
+		back := c.ll.Back()
+		if back == nil {
+			break
+		}
+		old := back.Value.(cacheEntry)
+		c.ll.Remove(back)
+		delete(c.items, old.key)
+		c.curBytes -= old.size
+	}
+}
+
+// pageCache caches rendered markdown pages, see serveRendered.
+var pageCache = newLRUCache(0)
@@ -0,0 +1,233 @@
+//  Copyright Brian Starkey <stark3y@gmail.com> 2016
+//
+//  Permission is hereby granted, free of charge, to any person obtaining a
+//  copy of this software and associated documentation files (the "Software"),
+//  to deal in the Software without restriction, including without limitation
+//  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+//  and/or sell copies of the Software, and to permit persons to whom the
+//  Software is furnished to do so, subject to the following conditions:
+//
+//  The above copyright notice and this permission notice shall be included in
+//  all copies or substantial portions of the Software.
+//
+//  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+//  OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+//  DEALINGS IN THE SOFTWARE.
+//
+// This file implements "codewalks" - guided tours over the document root,
+// in the spirit of the Go website's codewalk feature: a small manifest
+// names an ordered list of steps, each a highlighted range of lines in a
+// file with an accompanying comment. They're served at /codewalk/<name>,
+// reading <name>.codewalk (an XML manifest) from the document root.
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/shurcooL/github_flavored_markdown"
+)
+
+var codewalkTemplate *template.Template
+
+const defaultCodewalkTemplate = `
+<html>
+	<head>
+		<title>{{ .Title }}</title>
+		<meta charset="utf-8">
+		<style>
+			body { display: flex; }
+			.codewalk-comments { width: 40%; overflow-y: auto; }
+			.codewalk-file { width: 60%; overflow: auto; }
+			.codewalk-current { background: #ffe; }
+			.codewalk-hl { background: #ffd; display: inline-block; width: 100%; }
+		</style>
+	</head>
+	<body>
+		<div class="codewalk-comments">
+			<h1>{{ .Title }}</h1>
+			{{ range $i, $step := .Steps }}
+			<div class="codewalk-step{{ if eq $i $.Current }} codewalk-current{{ end }}">
+				<a href="?step={{ $i }}"><h2>{{ $step.File }}:{{ $step.Lo }}-{{ $step.Hi }}</h2></a>
+				{{ $step.CommentHTML }}
+			</div>
+			{{ end }}
+		</div>
+		<div class="codewalk-file">
+			{{ .FileHTML }}
+		</div>
+	</body>
+</html>
+`
+
+// Step is one step of a Codewalk: a highlighted range of lines in a file,
+// with an accompanying comment.
+type Step struct {
+	File    string `xml:"file,attr" json:"file"`
+	Lo      int    `xml:"lo,attr" json:"lo"`
+	Hi      int    `xml:"hi,attr" json:"hi"`
+	Comment string `xml:"comment" json:"comment"`
+
+	// CommentHTML is filled in at render time and omitted from the JSON
+	// form of the manifest, which carries the raw comment markdown.
+	CommentHTML string `xml:"-" json:"-"`
+}
+
+// Codewalk is a guided tour over a handful of files in the document root,
+// described by a small XML manifest.
+type Codewalk struct {
+	XMLName xml.Name `xml:"codewalk" json:"-"`
+	Title   string   `xml:"title,attr" json:"title"`
+	Steps   []Step   `xml:"step" json:"steps"`
+}
+
+// codewalkPage is the data passed to codewalkTemplate.
+type codewalkPage struct {
+	Title    string
+	Name     string
+	Steps    []Step
+	Current  int
+	FileHTML string
+}
+
+func loadCodewalk(path string) (*Codewalk, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cw := &Codewalk{}
+	if err := xml.Unmarshal(dat, cw); err != nil {
+		return nil, err
+	}
+
+	return cw, nil
+}
+
+// highlightFile reads file and renders it as a <pre> block with the lines
+// in [lo, hi] (inclusive, 1-indexed) marked up for highlighting.
+func highlightFile(file string, lo, hi int) (string, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("<pre>")
+	for i, line := range strings.Split(string(dat), "\n") {
+		n := i + 1
+		escaped := html.EscapeString(line)
+		if n >= lo && n <= hi {
+			fmt.Fprintf(&b, "<span class=\"codewalk-hl\">%s</span>\n", escaped)
+		} else {
+			fmt.Fprintf(&b, "%s\n", escaped)
+		}
+	}
+	b.WriteString("</pre>")
+
+	return b.String(), nil
+}
+
+func buildCodewalkPage(r *http.Request, cw *Codewalk, name string, step int) (*codewalkPage, error) {
+	if step < 0 || step >= len(cw.Steps) {
+		step = 0
+	}
+
+	page := &codewalkPage{
+		Title:   cw.Title,
+		Name:    name,
+		Steps:   make([]Step, len(cw.Steps)),
+		Current: step,
+	}
+	copy(page.Steps, cw.Steps)
+
+	for i := range page.Steps {
+		md := page.Steps[i].Comment
+		page.Steps[i].CommentHTML = string(github_flavored_markdown.Markdown([]byte(md))[:])
+	}
+
+	if len(cw.Steps) == 0 {
+		return page, nil
+	}
+
+	cur := cw.Steps[step]
+	file, err := resolvePath(filepath.Join(root, cur.File))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccess(file, r); err != nil {
+		return nil, err
+	}
+
+	fileHTML, err := highlightFile(file, cur.Lo, cur.Hi)
+	if err != nil {
+		return nil, err
+	}
+	page.FileHTML = fileHTML
+
+	return page, nil
+}
+
+func handleCodewalk(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s\n", dumpRequest(r))
+
+	name := strings.TrimPrefix(r.URL.Path, "/codewalk/")
+	if name == "" || strings.Contains(name, "/") {
+		handleError(w, r, &RequestError{r.URL.Path, "Not found", http.StatusNotFound})
+		return
+	}
+
+	manifest, err := resolvePath(filepath.Join(root, name+".codewalk"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if err := checkAccess(manifest, r); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	cw, err := loadCodewalk(manifest)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if r.Form.Get("fmt") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cw); err != nil {
+			log.Printf("*-> Error: %s\n", err)
+		}
+		return
+	}
+
+	step, _ := strconv.Atoi(r.Form.Get("step"))
+	page, err := buildCodewalkPage(r, cw, name, step)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if err := codewalkTemplate.Execute(w, page); err != nil {
+		log.Printf("*-> Error: %s\n", err)
+	}
+}
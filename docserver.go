@@ -25,7 +25,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/codegangsta/cli"
-	"github.com/shurcooL/github_flavored_markdown"
 	"io/ioutil"
 	"log"
 	"mime"
@@ -33,15 +32,23 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"syscall"
 	"text/template"
+	"time"
 )
 
 var pageTemplate *template.Template
 var errorTemplate *template.Template
 var root string
 
-const maxLinkLevels = 5
+// maxSymlinkDepth bounds how many symlinks resolvePath will follow before
+// giving up. The default is deliberately generous - well beyond any
+// reasonable symlink farm - since genuine A->B->A cycles are now caught
+// immediately via the visited set in resolvePath, rather than by this
+// counter. It's configurable via --max-symlink-depth for trees that
+// legitimately need to go deeper.
+var maxSymlinkDepth = 255
 
 var indexes = []string{
 	"index.md",
@@ -55,9 +62,11 @@ const defaultPage string = `
 	<head>
 		<title>{{ .Title }}</title>
 		<meta charset="utf-8">
+		{{ if .Meta.Description }}<meta name="description" content="{{ .Meta.Description }}">{{ end }}
 	</head>
 	<body>
 		<article>
+		{{ if .Meta.TOC }}{{ .Meta.TOC }}{{ end }}
 		{{ .Markup }}
 		</article>
 	</body>
@@ -135,23 +144,102 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 type Page struct {
 	Title  string
 	Markup string
+	Meta   Meta
 }
 
-func serveMarkdown(w http.ResponseWriter, r *http.Request, file string) {
-	log.Printf("`-> Serving markdown: %s\n", file)
-	md, err := ioutil.ReadFile(file)
+func serveRendered(w http.ResponseWriter, r *http.Request, file string, rnd Renderer) {
+	log.Printf("`-> Serving rendered file: %s\n", file)
+
+	fi, err := os.Stat(file)
 	if err != nil {
 		handleError(w, r, &RequestError{r.URL.Path, "Couldn't read file",
 			http.StatusNotFound})
 		return
 	}
 
-	title, _ := filepath.Rel(root, file)
+	etag := etagFor(fi, templateModTime)
+	if checkConditional(w, r, etag, fi.ModTime()) {
+		return
+	}
+	cacheKey := file + "|" + etag
+
+	var markup []byte
+	var meta Meta
+	var templateName string
+
+	if entry, ok := pageCache.get(cacheKey); ok {
+		log.Printf("|-> Cache hit: %s\n", file)
+		markup, meta, templateName = entry.markup, entry.meta, entry.template
+	} else {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			handleError(w, r, &RequestError{r.URL.Path, "Couldn't read file",
+				http.StatusNotFound})
+			return
+		}
+
+		fm := FrontMatter{Data: map[string]interface{}{}}
+		if filepath.Ext(file) == ".md" {
+			fm, src, err = splitFrontMatter(src)
+			if err != nil {
+				handleError(w, r, &RequestError{r.URL.Path, "Couldn't parse front-matter",
+					http.StatusInternalServerError})
+				return
+			}
+			if fm.Redirect != "" {
+				handleRedirect(w, r, fm.Redirect)
+				return
+			}
+		}
+
+		markup, meta, err = rnd.Render(src, RenderContext{URL: r.URL})
+		if err != nil {
+			handleError(w, r, &RequestError{r.URL.Path, "Couldn't render file",
+				http.StatusInternalServerError})
+			return
+		}
+
+		if fm.Title != "" {
+			meta.Title = fm.Title
+		}
+		if fm.Description != "" {
+			meta.Description = fm.Description
+		}
+		meta.Layout = fm.Layout
+		meta.Data = fm.Data
+		templateName = fm.Template
+
+		pageCache.set(cacheEntry{
+			key:      cacheKey,
+			markup:   markup,
+			meta:     meta,
+			template: templateName,
+			size:     int64(len(markup)),
+		})
+	}
+
+	if meta.Title == "" {
+		meta.Title, _ = filepath.Rel(root, file)
+	}
+
 	page := &Page{
-		Title:  title,
-		Markup: string(github_flavored_markdown.Markdown(md)[:]),
+		Title:  meta.Title,
+		Markup: string(markup),
+		Meta:   meta,
+	}
+
+	tmpl := pageTemplate
+	if templateName != "" && templatesDir != "" {
+		t, err := namedTemplate(templateName)
+		if err != nil {
+			handleError(w, r, &RequestError{r.URL.Path, "Couldn't load template",
+				http.StatusInternalServerError})
+			return
+		}
+		tmpl = t
 	}
-	err = pageTemplate.Execute(w, page)
+
+	err = tmpl.Execute(w, page)
 	if err != nil {
 		log.Printf("*-> Error: %s\n", err)
 	}
@@ -161,10 +249,22 @@ func serveMarkdown(w http.ResponseWriter, r *http.Request, file string) {
 func handleFile(w http.ResponseWriter, r *http.Request, filename string) {
 	ext := filepath.Ext(filename)
 	_, raw := r.Form["raw"]
-	if ext == ".md" && !raw {
-		serveMarkdown(w, r, filename)
+	if rnd, ok := renderers[ext]; ok && !raw {
+		serveRendered(w, r, filename, rnd)
 	} else {
 		log.Printf("`-> Serving file: %s\n", filename)
+
+		fi, err := os.Stat(filename)
+		if err != nil {
+			handleError(w, r, &RequestError{r.URL.Path, "Couldn't read file",
+				http.StatusNotFound})
+			return
+		}
+
+		if checkConditional(w, r, etagFor(fi, time.Time{}), fi.ModTime()) {
+			return
+		}
+
 		mimeType := mime.TypeByExtension(ext)
 		if mimeType != "" {
 			w.Header().Set("Content-Type", mimeType)
@@ -197,14 +297,35 @@ func rootPath(path string, root string) string {
 	return filepath.Clean(filepath.Join(root, path))
 }
 
+// resolvePath follows path while it refers to a symlink, returning the
+// first non-symlink path it reaches. Rather than bailing out after a fixed
+// number of hops, it tracks the canonicalized absolute path of every link
+// it has followed: a genuine A->B->A cycle is reported as soon as it
+// repeats, while a long-but-acyclic chain of distinct symlinks is allowed
+// up to maxSymlinkDepth.
 func resolvePath(path string) (newpath string, err error) {
 	log.Printf("|-> Resolving: %s", path)
+	visited := make(map[string]bool)
+
 	fi, err := os.Lstat(path)
 	if err != nil {
 		return path, err
 	}
 
-	for level := 0; isSymLink(fi) && level < maxLinkLevels; level++ {
+	for isSymLink(fi) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return path, err
+		}
+		canon := filepath.Clean(abs)
+		if visited[canon] {
+			return path, fmt.Errorf("Symlink loop detected at: %s", canon)
+		}
+		visited[canon] = true
+		if len(visited) > maxSymlinkDepth {
+			return path, errors.New("Too many levels of indirection")
+		}
+
 		target, err := os.Readlink(path)
 		if err != nil {
 			return path, err
@@ -221,13 +342,6 @@ func resolvePath(path string) (newpath string, err error) {
 		if err != nil {
 			return path, err
 		}
-
-		if !isSymLink(fi) {
-			break
-		}
-	}
-	if isSymLink(fi) {
-		return path, errors.New("Too many levels of indirection")
 	}
 
 	return path, nil
@@ -298,62 +412,6 @@ func replaceTrailingSlash(p string, request string) string {
 	return p
 }
 
-func handleRequest(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s\n", dumpRequest(r))
-
-	p := filepath.Join(root, r.URL.Path)
-
-	p, err := resolvePath(p)
-	if err != nil {
-		handleError(w, r, err)
-		return
-	}
-
-	fi, err := os.Stat(p)
-	if err != nil {
-		handleError(w, r, err)
-		return
-	} else if fi.IsDir() {
-		p = replaceTrailingSlash(p, r.URL.Path)
-		if p[len(p) - 1] != '/' {
-			// Force a trailing slash, which makes sure relative resources
-			// resolve properly
-			p, err = filepath.Rel(root, p)
-			p = "/" + p + "/"
-		} else {
-			p, err = findIndex(p, r)
-			if err != nil {
-				handleError(w, r, err)
-				return
-			} else {
-				p, err = filepath.Rel(root, p)
-				p = "/" + p
-			}
-		}
-
-		if err != nil {
-			handleError(w, r, err)
-		} else {
-			// FIXME: Do we really want to redirect indexes?
-			handleRedirect(w, r, p)
-		}
-		return
-	}
-
-	err = checkAccess(p, r)
-	if err != nil {
-		handleError(w, r, err)
-	} else {
-		log.Printf("|-> Resolved: %s\n", p)
-		err = r.ParseForm()
-		if err != nil {
-			handleError(w, r, err)
-		} else {
-			handleFile(w, r, p)
-		}
-	}
-}
-
 func runServer(c *cli.Context) {
 	var err error
 
@@ -363,11 +421,19 @@ func runServer(c *cli.Context) {
 	} else {
 		log.Printf("Using template: %s\n", templateFile)
 		pageTemplate, err = template.ParseFiles(templateFile)
+		if fi, serr := os.Stat(templateFile); serr == nil {
+			templateModTime = fi.ModTime()
+		}
 	}
 	if err != nil {
 		log.Fatalf("Error parsing template: %s\n", err)
 	}
 
+	codewalkTemplate, err = template.New("codewalk").Parse(defaultCodewalkTemplate)
+	if err != nil {
+		log.Fatalf("Error parsing codewalk template: %s\n", err)
+	}
+
 	templateFile = c.GlobalString("error-template")
 	if templateFile == "" {
 		errorTemplate, err = template.New("error-page").Parse(errorPage)
@@ -382,6 +448,8 @@ func runServer(c *cli.Context) {
 	root = c.GlobalString("root")
 	log.Printf("Document root: %s\n", root)
 
+	maxSymlinkDepth = c.GlobalInt("max-symlink-depth")
+
 	if c.GlobalBool("chroot") {
 		log.Printf("`-> chroot() into document root\n")
 		err = syscall.Chroot(root)
@@ -403,9 +471,63 @@ func runServer(c *cli.Context) {
 		}
 	}
 
+	browse = c.GlobalBool("browse")
+
+	browsePathFlag := c.GlobalStringSlice("browse-path")
+	if len(browsePathFlag) > 0 {
+		browsePatterns = make([]*regexp.Regexp, len(browsePathFlag))
+		for i, f := range browsePathFlag {
+			log.Printf("Adding browse-path: %s\n", f)
+			browsePatterns[i], err = regexp.Compile(f)
+			if err != nil {
+				log.Fatalf("`-> regexp.Compile failed: %s", err)
+			}
+		}
+	}
+
+	templateFile = c.GlobalString("browse-template")
+	if templateFile == "" {
+		browseTemplate, err = template.New("browse-page").Parse(defaultBrowseTemplate)
+	} else {
+		log.Printf("Using browse-template: %s\n", templateFile)
+		browseTemplate, err = template.ParseFiles(templateFile)
+	}
+	if err != nil {
+		log.Fatalf("Error parsing browse-template: %s\n", err)
+	}
+
+	for ext, name := range defaultRenderers {
+		renderers[ext] = rendererByName[name]
+	}
+	for _, m := range c.GlobalStringSlice("renderer") {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid --renderer mapping (want ext=name): %s", m)
+		}
+		ext, name := parts[0], parts[1]
+		rnd, ok := rendererByName[name]
+		if !ok {
+			log.Fatalf("Unknown renderer: %s", name)
+		}
+		log.Printf("Using renderer %s for %s\n", name, ext)
+		renderers[ext] = rnd
+	}
+
+	templatesDir = c.GlobalString("templates-dir")
+	if templatesDir != "" {
+		log.Printf("Using templates-dir: %s\n", templatesDir)
+	}
+
+	cacheSizeMB := c.GlobalInt("cache-size")
+	if cacheSizeMB > 0 {
+		log.Printf("Rendered-page cache size: %dMB\n", cacheSizeMB)
+	}
+	pageCache = newLRUCache(int64(cacheSizeMB) * 1024 * 1024)
+
 	addr := c.GlobalString("addr")
 	log.Printf("Serving on '%s'\n", addr)
 
+	http.HandleFunc("/codewalk/", handleCodewalk)
 	http.HandleFunc("/", handleRequest)
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
@@ -422,8 +544,12 @@ func main() {
 			Usage: "Template file for rendering Markdown pages - see text/template.\n" +
 				"\tIf not provided, then a default template is used which defines a basic HTML page\n" +
 				"\tAvailable variables:\n" +
-				"\t\t.Title:  Page title\n" +
-				"\t\t.Markup: HTML page content",
+				"\t\t.Title:             Page title\n" +
+				"\t\t.Markup:            HTML page content\n" +
+				"\t\t.Meta.TOC:          Table of contents, if the renderer supports it\n" +
+				"\t\t.Meta.Description:  Page description, from front-matter\n" +
+				"\t\t.Meta.Layout:       Layout name, from front-matter\n" +
+				"\t\t.Meta.Data:         Other front-matter keys",
 		},
 		cli.StringFlag{
 			Name:  "error-template",
@@ -440,6 +566,13 @@ func main() {
 			Value: ".",
 			Usage: "Root directory to serve files from",
 		},
+		cli.IntFlag{
+			Name:  "max-symlink-depth",
+			Value: 255,
+			Usage: "How many symlinks resolvePath will follow while resolving a\n" +
+				"\tpath, before giving up. Genuine A->B->A cycles are caught\n" +
+				"\timmediately regardless of this value",
+		},
 		cli.StringFlag{
 			Name:  "addr",
 			Value: ":8000",
@@ -455,6 +588,49 @@ func main() {
 			Usage: "Regular expression to use for request filtering.\n" +
 				"\tAny requests which resolve to a file matching any filter will 404",
 		},
+		cli.BoolFlag{
+			Name: "browse",
+			Usage: "If set, directories with no index file will render an\n" +
+				"\tauto-generated directory listing instead of returning 404",
+		},
+		cli.StringSliceFlag{
+			Name: "browse-path",
+			Usage: "Regular expression matching paths (relative to root) which\n" +
+				"\tshould have directory listings enabled, even without --browse",
+		},
+		cli.StringFlag{
+			Name:  "browse-template",
+			Value: "",
+			Usage: "Template file for rendering directory listings - see text/template.\n" +
+				"\tIf not provided, then a default template is used\n" +
+				"\tAvailable variables:\n" +
+				"\t\t.Name:     Directory name\n" +
+				"\t\t.Path:     Directory path\n" +
+				"\t\t.CanGoUp:  Whether a parent directory link should be shown\n" +
+				"\t\t.Items:    []FileInfo of directory entries\n" +
+				"\t\t.NumDirs:  Number of sub-directories\n" +
+				"\t\t.NumFiles: Number of files\n" +
+				"\t\t.Sort:     Current sort field\n" +
+				"\t\t.Order:    Current sort order",
+		},
+		cli.StringSliceFlag{
+			Name: "renderer",
+			Usage: "Override the renderer used for a file extension, as ext=name.\n" +
+				"\tBuilt-in renderers are: gfm (default for .md), blackfriday, plain (default for .txt)",
+		},
+		cli.StringFlag{
+			Name:  "templates-dir",
+			Value: "",
+			Usage: "Directory of named page templates, selectable per-document via the\n" +
+				"\t`template` front-matter key. All files in the directory are parsed\n" +
+				"\ttogether, so they can compose via {{ template \"layout.html\" . }}",
+		},
+		cli.IntFlag{
+			Name:  "cache-size",
+			Value: 0,
+			Usage: "Size (in MB) of the in-memory LRU cache of rendered pages.\n" +
+				"\t0 (the default) disables the cache",
+		},
 	}
 	app.Action = runServer
 
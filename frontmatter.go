@@ -0,0 +1,178 @@
+//  Copyright Brian Starkey <stark3y@gmail.com> 2016
+//
+//  Permission is hereby granted, free of charge, to any person obtaining a
+//  copy of this software and associated documentation files (the "Software"),
+//  to deal in the Software without restriction, including without limitation
+//  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+//  and/or sell copies of the Software, and to permit persons to whom the
+//  Software is furnished to do so, subject to the following conditions:
+//
+//  The above copyright notice and this permission notice shall be included in
+//  all copies or substantial portions of the Software.
+//
+//  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+//  OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+//  DEALINGS IN THE SOFTWARE.
+//
+// This file implements optional per-document front-matter: a YAML (---
+// delimited) or TOML (+++ delimited) metadata block at the top of a file,
+// as popularized by static site generators like Jekyll and Hugo. It also
+// implements selecting a named page template per-document, loaded from
+// --templates-dir.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FrontMatter is the recognized subset of a document's front-matter.
+// Anything else found in the block ends up in Data.
+type FrontMatter struct {
+	Title       string
+	Description string
+	Template    string
+	Layout      string
+	Redirect    string
+	Data        map[string]interface{}
+}
+
+// splitFrontMatter looks for a --- or +++ delimited front-matter block at
+// the start of src, parsing it as YAML or TOML respectively. If src has
+// no recognizable front-matter, it's returned unchanged with a zero
+// FrontMatter.
+func splitFrontMatter(src []byte) (fm FrontMatter, body []byte, err error) {
+	fm.Data = map[string]interface{}{}
+
+	var delim string
+	switch {
+	case bytes.HasPrefix(src, []byte("---\n")):
+		delim = "---"
+	case bytes.HasPrefix(src, []byte("+++\n")):
+		delim = "+++"
+	default:
+		return fm, src, nil
+	}
+
+	rest := src[len(delim)+1:]
+	closer := []byte("\n" + delim + "\n")
+	end := bytes.Index(rest, closer)
+	if end == -1 {
+		// No closing fence - this isn't front-matter after all.
+		return FrontMatter{Data: map[string]interface{}{}}, src, nil
+	}
+
+	block := rest[:end]
+	body = rest[end+len(closer):]
+
+	raw := map[string]interface{}{}
+	if delim == "---" {
+		err = yaml.Unmarshal(block, &raw)
+	} else {
+		err = toml.Unmarshal(block, &raw)
+	}
+	if err != nil {
+		return fm, src, err
+	}
+
+	for k, v := range raw {
+		switch k {
+		case "title":
+			fm.Title, _ = v.(string)
+		case "description":
+			fm.Description, _ = v.(string)
+		case "template":
+			fm.Template, _ = v.(string)
+		case "layout":
+			fm.Layout, _ = v.(string)
+		case "redirect":
+			fm.Redirect, _ = v.(string)
+		default:
+			fm.Data[k] = v
+		}
+	}
+
+	return fm, body, nil
+}
+
+// templatesDir is the directory of named templates set via
+// --templates-dir, or "" if document template selection is disabled.
+var templatesDir string
+
+// namedTemplateCache guards the parsed *template.Template set for
+// templatesDir, since namedTemplate is called from the per-request
+// goroutines net/http spawns for every connection. modTime is the latest
+// mtime seen across templatesDir as of when set was parsed, so editing a
+// template file invalidates the cache without requiring a restart.
+var namedTemplateCache = struct {
+	mu      sync.Mutex
+	modTime time.Time
+	set     map[string]*template.Template
+}{set: map[string]*template.Template{}}
+
+// templatesDirModTime returns the most recent mtime of any file directly
+// inside templatesDir.
+func templatesDirModTime() (time.Time, error) {
+	entries, err := ioutil.ReadDir(templatesDir)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var latest time.Time
+	for _, fi := range entries {
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// namedTemplate returns the template called name from templatesDir,
+// parsing the whole directory together the first time that name is
+// requested and caching the result per name, so templates in it can
+// compose with each other via {{ template "other.html" . }}. The cache is invalidated
+// whenever a file in templatesDir is modified, so editing a template
+// takes effect without recompiling or restarting docserver.
+func namedTemplate(name string) (*template.Template, error) {
+	namedTemplateCache.mu.Lock()
+	defer namedTemplateCache.mu.Unlock()
+
+	modTime, err := templatesDirModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	if modTime.After(namedTemplateCache.modTime) {
+		namedTemplateCache.set = map[string]*template.Template{}
+		namedTemplateCache.modTime = modTime
+	}
+
+	if t, ok := namedTemplateCache.set[name]; ok {
+		return t, nil
+	}
+
+	set, err := template.ParseGlob(filepath.Join(templatesDir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	t := set.Lookup(name)
+	if t == nil {
+		return nil, fmt.Errorf("No such template: %s", name)
+	}
+
+	namedTemplateCache.set[name] = t
+	return t, nil
+}
@@ -0,0 +1,179 @@
+//  Copyright Brian Starkey <stark3y@gmail.com> 2016
+//
+//  Permission is hereby granted, free of charge, to any person obtaining a
+//  copy of this software and associated documentation files (the "Software"),
+//  to deal in the Software without restriction, including without limitation
+//  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+//  and/or sell copies of the Software, and to permit persons to whom the
+//  Software is furnished to do so, subject to the following conditions:
+//
+//  The above copyright notice and this permission notice shall be included in
+//  all copies or substantial portions of the Software.
+//
+//  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+//  OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+//  DEALINGS IN THE SOFTWARE.
+//
+// This file implements handleRequest as a small Caddy-style internal
+// rewrite chain: each stage either serves the response itself, rewrites
+// the path and asks to be fed back through the chain from the top, or
+// lets the next stage have a go. This lets the different concerns that
+// used to live in one monolithic handleRequest (symlink resolution,
+// access filtering, directory/index handling, file serving) compose
+// independently.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// stageAction describes what the chain should do once a stage returns.
+type stageAction int
+
+const (
+	// actionContinue lets the next stage in the chain run on the returned
+	// path, without restarting the chain from the top.
+	actionContinue stageAction = iota
+	// actionRewrite feeds the returned path back through the chain from
+	// the first stage, as an internal redirect.
+	actionRewrite
+	// actionDone means the stage has already written the response (or an
+	// error has occurred), and the chain should stop.
+	actionDone
+)
+
+// stage is one link in the internal rewrite chain.
+type stage func(w http.ResponseWriter, r *http.Request, p string) (next string, action stageAction, err error)
+
+var chain = []stage{
+	rewriteStage,
+	filterStage,
+	directoryStage,
+	serveStage,
+}
+
+// maxChainLevels bounds how many internal redirects handleRequest will
+// follow. Genuine A->B->A cycles are caught immediately via the visited
+// set below, so this is just a backstop.
+const maxChainLevels = 10
+
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s\n", dumpRequest(r))
+
+	p := filepath.Join(root, r.URL.Path)
+	visited := make(map[string]bool)
+
+	for i := 0; i < maxChainLevels; i++ {
+		canon := filepath.Clean(p)
+		if visited[canon] {
+			handleError(w, r, fmt.Errorf("Internal redirect loop at: %s", canon))
+			return
+		}
+		visited[canon] = true
+
+		rewritten := false
+		for _, s := range chain {
+			next, action, err := s(w, r, p)
+			if err != nil {
+				handleError(w, r, err)
+				return
+			}
+
+			p = next
+
+			switch action {
+			case actionDone:
+				return
+			case actionRewrite:
+				rewritten = true
+			}
+
+			if rewritten {
+				break
+			}
+		}
+
+		if !rewritten {
+			return
+		}
+	}
+
+	handleError(w, r, &RequestError{r.URL.Path, "Too many levels of indirection",
+		http.StatusInternalServerError})
+}
+
+// rewriteStage resolves symlinks in p before anything else sees it.
+func rewriteStage(w http.ResponseWriter, r *http.Request, p string) (string, stageAction, error) {
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return p, actionDone, err
+	}
+	return resolved, actionContinue, nil
+}
+
+// filterStage applies the root-traversal and --filter checks to p,
+// whichever kind of thing p turns out to be.
+func filterStage(w http.ResponseWriter, r *http.Request, p string) (string, stageAction, error) {
+	if err := checkAccess(p, r); err != nil {
+		return p, actionDone, err
+	}
+	return p, actionContinue, nil
+}
+
+// directoryStage handles the case where p is a directory: forcing a
+// trailing slash, finding (and internally rewriting to) an index file, or
+// falling back to an auto-generated listing.
+func directoryStage(w http.ResponseWriter, r *http.Request, p string) (string, stageAction, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return p, actionDone, err
+	}
+	if !fi.IsDir() {
+		return p, actionContinue, nil
+	}
+
+	withSlash := replaceTrailingSlash(p, r.URL.Path)
+	if withSlash[len(withSlash)-1] != '/' {
+		// Force a trailing slash, which makes sure relative resources
+		// resolve properly
+		rel, err := filepath.Rel(root, withSlash)
+		if err != nil {
+			return p, actionDone, err
+		}
+		handleRedirect(w, r, "/"+rel+"/")
+		return p, actionDone, nil
+	}
+
+	index, err := findIndex(withSlash, r)
+	if err != nil {
+		if shouldBrowse(withSlash) {
+			serveBrowse(w, r, withSlash)
+			return p, actionDone, nil
+		}
+		return p, actionDone, err
+	}
+
+	// Serve the index as an internal rewrite, rather than an HTTP
+	// redirect, so the directory URL stays in the browser's address bar.
+	return index, actionRewrite, nil
+}
+
+// serveStage is the terminal stage: by the time it runs, p should refer to
+// a plain file.
+func serveStage(w http.ResponseWriter, r *http.Request, p string) (string, stageAction, error) {
+	if err := r.ParseForm(); err != nil {
+		return p, actionDone, err
+	}
+
+	log.Printf("|-> Resolved: %s\n", p)
+	handleFile(w, r, p)
+	return p, actionDone, nil
+}
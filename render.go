@@ -0,0 +1,183 @@
+//  Copyright Brian Starkey <stark3y@gmail.com> 2016
+//
+//  Permission is hereby granted, free of charge, to any person obtaining a
+//  copy of this software and associated documentation files (the "Software"),
+//  to deal in the Software without restriction, including without limitation
+//  the rights to use, copy, modify, merge, publish, distribute, sublicense,
+//  and/or sell copies of the Software, and to permit persons to whom the
+//  Software is furnished to do so, subject to the following conditions:
+//
+//  The above copyright notice and this permission notice shall be included in
+//  all copies or substantial portions of the Software.
+//
+//  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+//  OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+//  FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+//  DEALINGS IN THE SOFTWARE.
+//
+// This file implements the pluggable renderer registry: a map from file
+// extension to a Renderer, so serveRendered doesn't have to hardcode a
+// single markdown implementation.
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/russross/blackfriday"
+	"github.com/shurcooL/github_flavored_markdown"
+)
+
+// RenderContext carries the per-request information a Renderer may need
+// in order to adapt its output, e.g. to rewrite relative links.
+type RenderContext struct {
+	URL *url.URL
+}
+
+// Meta is metadata a Renderer can extract from a document, surfaced to
+// the page template as .Meta in addition to the plain .Title/.Markup
+// fields Page has always had.
+type Meta struct {
+	Title       string
+	TOC         string
+	Description string
+
+	// Layout and Data come from a document's front-matter, if any - see
+	// frontmatter.go.
+	Layout string
+	Data   map[string]interface{}
+}
+
+// Renderer turns a file's raw bytes into HTML.
+type Renderer interface {
+	Render(src []byte, ctx RenderContext) (out []byte, meta Meta, err error)
+}
+
+// hrefRe matches an href attribute value in rendered HTML, so
+// rewriteRelativeLinks can find the links a renderer emitted.
+var hrefRe = regexp.MustCompile(`href="([^"]*)"`)
+
+// rewriteRelativeLinks resolves relative link targets in out (as emitted
+// by a Renderer) against the directory of the page currently being
+// served, so a link like "../foo.md" keeps working no matter how deeply
+// the linking page is nested under root. Absolute URLs, scheme-relative
+// URLs, root-relative paths and fragment-only links are left alone.
+func rewriteRelativeLinks(out []byte, ctx RenderContext) []byte {
+	if ctx.URL == nil {
+		return out
+	}
+
+	dir := path.Dir(ctx.URL.Path)
+
+	return hrefRe.ReplaceAllFunc(out, func(m []byte) []byte {
+		href := string(hrefRe.FindSubmatch(m)[1])
+
+		if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(href, "/") {
+			return m
+		}
+		if u, err := url.Parse(href); err != nil || u.IsAbs() || strings.HasPrefix(href, "//") {
+			return m
+		}
+
+		return []byte(`href="` + path.Join(dir, href) + `"`)
+	})
+}
+
+// renderers maps a file extension (as returned by filepath.Ext, including
+// the leading dot) to the Renderer that should handle it. It's populated
+// from defaultRenderers and any --renderer overrides in runServer.
+var renderers = map[string]Renderer{}
+
+// defaultRenderers is the out-of-the-box ext -> renderer name mapping.
+var defaultRenderers = map[string]string{
+	".md":  "gfm",
+	".txt": "plain",
+}
+
+// rendererByName is the registry of renderers available to select by
+// name, either as a default above or via --renderer ext=name.
+var rendererByName = map[string]Renderer{
+	"gfm":         gfmRenderer{},
+	"blackfriday": blackfridayRenderer{},
+	"plain":       plainRenderer{},
+}
+
+// gfmRenderer renders GitHub Flavored Markdown, same as docserver has
+// always done.
+type gfmRenderer struct{}
+
+func (gfmRenderer) Render(src []byte, ctx RenderContext) ([]byte, Meta, error) {
+	return rewriteRelativeLinks(github_flavored_markdown.Markdown(src), ctx), Meta{}, nil
+}
+
+// plainRenderer wraps a file's contents verbatim in a <pre>, for plain
+// text files that aren't markdown.
+type plainRenderer struct{}
+
+func (plainRenderer) Render(src []byte, ctx RenderContext) ([]byte, Meta, error) {
+	out := "<pre>" + html.EscapeString(string(src)) + "</pre>"
+	return []byte(out), Meta{}, nil
+}
+
+// blackfridayRenderer renders markdown via blackfriday, which gives us a
+// table of contents and fenced-code syntax highlighting (via chroma) that
+// the default gfm renderer doesn't have.
+type blackfridayRenderer struct{}
+
+const blackfridayExtensions = blackfriday.EXTENSION_FENCED_CODE |
+	blackfriday.EXTENSION_TABLES |
+	blackfriday.EXTENSION_AUTOLINK |
+	blackfriday.EXTENSION_STRIKETHROUGH
+
+func (blackfridayRenderer) Render(src []byte, ctx RenderContext) ([]byte, Meta, error) {
+	htmlFlags := blackfriday.HTML_USE_XHTML | blackfriday.HTML_TOC
+	base := blackfriday.HtmlRenderer(htmlFlags, "", "")
+	renderer := chromaRenderer{Renderer: base}
+
+	out := blackfriday.MarkdownOptions(src, renderer, blackfriday.Options{
+		Extensions: blackfridayExtensions,
+	})
+
+	tocFlags := blackfriday.HTML_TOC | blackfriday.HTML_OMIT_CONTENTS
+	toc := blackfriday.Markdown(src, blackfriday.HtmlRenderer(tocFlags, "", ""), blackfridayExtensions)
+
+	return rewriteRelativeLinks(out, ctx), Meta{TOC: string(toc)}, nil
+}
+
+// chromaRenderer wraps a blackfriday.Renderer, replacing its BlockCode
+// with one that syntax-highlights the code via chroma.
+type chromaRenderer struct {
+	blackfriday.Renderer
+}
+
+func (c chromaRenderer) BlockCode(out *bytes.Buffer, text []byte, lang string) {
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	iterator, err := lexer.Tokenise(nil, string(text))
+	if err != nil {
+		c.Renderer.BlockCode(out, text, lang)
+		return
+	}
+
+	var buf bytes.Buffer
+	formatter := chromahtml.New(chromahtml.WithClasses(true))
+	if err := formatter.Format(&buf, styles.GitHub, iterator); err != nil {
+		c.Renderer.BlockCode(out, text, lang)
+		return
+	}
+
+	out.WriteString(buf.String())
+}